@@ -0,0 +1,23 @@
+// Package bson provides a scribble.Codec backed by BSON, for users who want
+// a compact binary on-disk format instead of scribble's default JSON.
+package bson
+
+import "gopkg.in/mgo.v2/bson"
+
+// BSONCodec is a scribble.Codec that (de)serializes records as BSON
+type BSONCodec struct{}
+
+// Marshal encodes v as BSON
+func (BSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return bson.Marshal(v)
+}
+
+// Unmarshal decodes BSON encoded data into v
+func (BSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return bson.Unmarshal(data, v)
+}
+
+// Extension returns the file extension BSON records are stored under
+func (BSONCodec) Extension() string {
+	return ".bson"
+}
@@ -0,0 +1,33 @@
+package scribble
+
+import "encoding/json"
+
+// Codec is the interface that wraps the serialization format used to
+// persist records to disk. Implementations control how a record is turned
+// into bytes (and back), as well as the file extension records are stored
+// under so that a directory can hold more than one format without readers
+// getting confused.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Extension() string
+}
+
+// JSONCodec is the default Codec used by a Driver. It preserves the
+// historical behavior of scribble: pretty-printed, tab-indented JSON.
+type JSONCodec struct{}
+
+// Marshal encodes v as indented JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "\t")
+}
+
+// Unmarshal decodes JSON encoded data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Extension returns the file extension JSON records are stored under
+func (JSONCodec) Extension() string {
+	return ".json"
+}
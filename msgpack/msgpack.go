@@ -0,0 +1,23 @@
+// Package msgpack provides a scribble.Codec backed by MessagePack, for users
+// who want a compact binary on-disk format instead of scribble's default JSON.
+package msgpack
+
+import "github.com/vmihailenco/msgpack"
+
+// MessagePackCodec is a scribble.Codec that (de)serializes records as MessagePack
+type MessagePackCodec struct{}
+
+// Marshal encodes v as MessagePack
+func (MessagePackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal decodes MessagePack encoded data into v
+func (MessagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// Extension returns the file extension MessagePack records are stored under
+func (MessagePackCodec) Extension() string {
+	return ".msgpack"
+}
@@ -0,0 +1,346 @@
+package scribble
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// indexPrefix marks the sidecar files CreateIndex persists inside a
+// collection directory, keeping them out of ReadAll/ReadAllMap/Query (which
+// only look at files ending in the codec's extension)
+const indexPrefix = ".index."
+
+// Query scans [collection], decoding each record and handing filter its
+// content as json.RawMessage (re-encoding it as JSON first if the driver's
+// codec isn't JSONCodec), and returns the resource names filter accepted.
+// This avoids the allocations of ReadAll followed by a caller-side
+// unmarshal-and-loop.
+//
+// The RLock taken only covers [collection] itself: if the walk descends
+// into nested sub-collections (e.g. ones built up with WritePath), those
+// serialize writes on their own mutexes and aren't protected by this lock,
+// so a Query spanning them can still race a concurrent write/flush there.
+func (d *Driver) Query(collection string, filter func(raw json.RawMessage) bool) ([]string, error) {
+
+	// ensure there is a collection to query
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - unable to read location!")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir := filepath.Join(d.dir, collection)
+	if _, err := stat(dir); err != nil {
+		return nil, fmt.Errorf("Directory '%s' does not exist - %s!", dir, err.Error())
+	}
+
+	var resources []string
+
+	err := d.readRecords(dir, func(resource string, b []byte) error {
+		raw, err := d.toJSON(b)
+		if err != nil {
+			return err
+		}
+
+		if filter(raw) {
+			resources = append(resources, resource)
+		}
+
+		return nil
+	})
+
+	return resources, err
+}
+
+// QueryInto behaves like Query, but decodes each record with the driver's
+// codec into out's element type (out must be a pointer to a slice) and hands
+// filter the decoded value instead of raw JSON, appending it to out when
+// filter accepts it. The same nested sub-collection caveat as Query applies.
+func (d *Driver) QueryInto(collection string, out interface{}, filter func(interface{}) bool) error {
+
+	// ensure there is a collection to query
+	if collection == "" {
+		return fmt.Errorf("Missing collection - unable to read location!")
+	}
+
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("QueryInto: out must be a pointer to a slice")
+	}
+	slice := rv.Elem()
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir := filepath.Join(d.dir, collection)
+	if _, err := stat(dir); err != nil {
+		return fmt.Errorf("Directory '%s' does not exist - %s!", dir, err.Error())
+	}
+
+	return d.readRecords(dir, func(_ string, b []byte) error {
+		elem := reflect.New(slice.Type().Elem())
+		if err := d.codec.Unmarshal(b, elem.Interface()); err != nil {
+			return err
+		}
+
+		if filter(elem.Elem().Interface()) {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+
+		return nil
+	})
+}
+
+// toJSON returns a record's contents as JSON, so Query has something
+// consistent to hand its filter regardless of the driver's codec
+func (d *Driver) toJSON(b []byte) (json.RawMessage, error) {
+	if _, ok := d.codec.(JSONCodec); ok {
+		return json.RawMessage(b), nil
+	}
+
+	var v interface{}
+	if err := d.codec.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// CreateIndex builds a map[value][]resource index over [jsonPath] (a
+// dot-separated path into each record, e.g. "address.city") for every
+// record currently in [collection], and persists it to a hidden sidecar
+// file. Once built, Write and Delete keep it up to date incrementally, and
+// Lookup can use it for O(1) point lookups instead of scanning the
+// collection.
+func (d *Driver) CreateIndex(collection, jsonPath string) error {
+
+	// ensure there is a collection to index
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to index!")
+	}
+	if jsonPath == "" {
+		return fmt.Errorf("Missing jsonPath - nothing to index!")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := filepath.Join(d.dir, collection)
+	if _, err := stat(dir); err != nil {
+		return fmt.Errorf("Directory '%s' does not exist - %s!", dir, err.Error())
+	}
+
+	index := make(map[string][]string)
+
+	err := d.readRecords(dir, func(resource string, b []byte) error {
+		value, ok, err := d.indexValue(b, jsonPath)
+		if err != nil {
+			return err
+		}
+		if ok {
+			index[value] = append(index[value], resource)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.saveIndex(collection, jsonPath, index)
+}
+
+// Lookup returns the resources in [collection] whose [jsonPath] field equals
+// [value], using the index CreateIndex built for that path
+func (d *Driver) Lookup(collection, jsonPath, value string) ([]string, error) {
+
+	// ensure there is a collection to look up
+	if collection == "" {
+		return nil, fmt.Errorf("Missing collection - no place to look up!")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	index, err := d.loadIndex(collection, jsonPath)
+	if err != nil {
+		return nil, fmt.Errorf("No index on '%s' for collection '%s' - %s!", jsonPath, collection, err.Error())
+	}
+
+	return index[value], nil
+}
+
+// indexValue decodes a record and walks jsonPath (split on ".") through it,
+// returning the value it finds there stringified, or ok=false if jsonPath
+// doesn't resolve (e.g. the record doesn't have that field)
+func (d *Driver) indexValue(b []byte, jsonPath string) (value string, ok bool, err error) {
+	var v interface{}
+	if err := d.codec.Unmarshal(b, &v); err != nil {
+		return "", false, err
+	}
+
+	for _, key := range strings.Split(jsonPath, ".") {
+		m, isMap := v.(map[string]interface{})
+		if !isMap {
+			return "", false, nil
+		}
+
+		v, ok = m[key]
+		if !ok {
+			return "", false, nil
+		}
+	}
+
+	return fmt.Sprintf("%v", v), true, nil
+}
+
+// updateIndexesOnWrite keeps every index built over [collection] in sync
+// with a record that was just written. Callers must already hold the
+// collection's mutex.
+func (d *Driver) updateIndexesOnWrite(collection, resource string, b []byte) error {
+	paths, err := d.indexPaths(collection)
+	if err != nil {
+		return err
+	}
+
+	for _, jsonPath := range paths {
+		index, err := d.loadIndex(collection, jsonPath)
+		if err != nil {
+			return err
+		}
+
+		removeFromIndex(index, resource)
+
+		value, ok, err := d.indexValue(b, jsonPath)
+		if err != nil {
+			return err
+		}
+		if ok {
+			index[value] = append(index[value], resource)
+		}
+
+		if err := d.saveIndex(collection, jsonPath, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateIndexesOnDelete keeps every index built over [collection] in sync
+// with a record that was just deleted. Callers must already hold the
+// collection's mutex.
+func (d *Driver) updateIndexesOnDelete(collection, resource string) error {
+	paths, err := d.indexPaths(collection)
+	if err != nil {
+		return err
+	}
+
+	for _, jsonPath := range paths {
+		index, err := d.loadIndex(collection, jsonPath)
+		if err != nil {
+			return err
+		}
+
+		removeFromIndex(index, resource)
+
+		if err := d.saveIndex(collection, jsonPath, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeFromIndex removes every occurrence of resource from index, dropping
+// any value whose resource list becomes empty
+func removeFromIndex(index map[string][]string, resource string) {
+	for value, resources := range index {
+		for i, r := range resources {
+			if r == resource {
+				resources = append(resources[:i], resources[i+1:]...)
+				break
+			}
+		}
+
+		if len(resources) == 0 {
+			delete(index, value)
+		} else {
+			index[value] = resources
+		}
+	}
+}
+
+// indexPaths returns the jsonPaths that have a sidecar index file in
+// [collection]
+func (d *Driver) indexPaths(collection string) ([]string, error) {
+	dir := filepath.Join(d.dir, collection)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var paths []string
+	for _, file := range files {
+		if jsonPath, ok := indexJSONPath(file.Name()); ok {
+			paths = append(paths, jsonPath)
+		}
+	}
+
+	return paths, nil
+}
+
+// indexFileName returns the sidecar file CreateIndex persists for jsonPath
+func indexFileName(jsonPath string) string {
+	return indexPrefix + jsonPath
+}
+
+// indexJSONPath reverses indexFileName, reporting whether name is an index sidecar file
+func indexJSONPath(name string) (string, bool) {
+	if !strings.HasPrefix(name, indexPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, indexPrefix), true
+}
+
+// saveIndex persists index as the sidecar file for jsonPath in [collection]
+func (d *Driver) saveIndex(collection, jsonPath string, index map[string][]string) error {
+	dir := filepath.Join(d.dir, collection)
+
+	b, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, indexFileName(jsonPath)), b, 0644)
+}
+
+// loadIndex reads back the sidecar file CreateIndex persisted for jsonPath in [collection]
+func (d *Driver) loadIndex(collection, jsonPath string) (map[string][]string, error) {
+	dir := filepath.Join(d.dir, collection)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, indexFileName(jsonPath)))
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string][]string)
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
@@ -2,17 +2,23 @@
 package scribble
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/jcelliott/lumber"
 )
 
+// metaFile is the hidden per-collection file WriteAutoID uses to persist its
+// auto-increment counter
+const metaFile = ".meta"
+
 type (
 
 	// Logger is a generic logger interface
@@ -29,15 +35,43 @@ type (
 	// transactions, and provides log output
 	Driver struct {
 		mutex   sync.Mutex
-		mutexes map[string]sync.Mutex
+		mutexes map[string]*sync.RWMutex
 		dir     string // the directory where scribble will create the database
 		log     Logger // the logger scribble will log to
+		codec   Codec  // the codec used to marshal/unmarshal records
+		wal     bool   // if true, writes/deletes go through a WAL before landing on disk
+		wals    map[string]*walCollection
+
+		// walFlushInterval is how often the background flusher checkpoints a
+		// collection once writes have started arriving for it; defaults to
+		// walFlushInterval if Options.WALFlushInterval is zero
+		walFlushInterval time.Duration
 	}
 )
 
 // Options uses for specification of working golang-scribble
 type Options struct {
 	Logger // the logger scribble will use (configurable)
+	Codec  // the codec scribble will use to (de)serialize records (configurable)
+
+	// WAL, if true, makes Write/WriteAutoID/WritePath and single-record
+	// Deletes append to a per-collection write-ahead log (fsynced) and return
+	// immediately, instead of writing the record file itself before
+	// returning; a Delete of a whole collection or sub-collection still
+	// removes it directly. A
+	// background flusher applies the log to the real files shortly after,
+	// and Checkpoint can force that to happen synchronously. This trades
+	// read-your-writes consistency (a read immediately after a write may
+	// still see the old file until the next flush) for write throughput
+	// under bursty workloads.
+	WAL bool
+
+	// WALFlushInterval overrides how often the background flusher
+	// checkpoints a collection once Options.WAL is enabled and writes have
+	// started arriving for it. Zero (the default) uses a 10ms interval;
+	// tests that need to assert on something before the flusher has run
+	// can set this to a long duration instead of racing it.
+	WALFlushInterval time.Duration
 }
 
 // New creates a new scribble database at the desired directory location, and
@@ -63,16 +97,40 @@ func New(dir string, options *Options) (*Driver, error) {
 		opts.Logger = lumber.NewConsoleLogger(lumber.INFO)
 	}
 
+	// if no codec is provided, default to JSON (the historical behavior)
+	if opts.Codec == nil {
+		opts.Codec = JSONCodec{}
+	}
+
+	// if no flush interval is provided, default to walFlushInterval
+	flushInterval := opts.WALFlushInterval
+	if flushInterval == 0 {
+		flushInterval = walFlushInterval
+	}
+
 	//
 	driver := Driver{
-		dir:     dir,
-		mutexes: make(map[string]sync.Mutex),
-		log:     opts.Logger,
+		dir:              dir,
+		mutexes:          make(map[string]*sync.RWMutex),
+		log:              opts.Logger,
+		codec:            opts.Codec,
+		wal:              opts.WAL,
+		wals:             make(map[string]*walCollection),
+		walFlushInterval: flushInterval,
 	}
 
 	// if the database already exists, just use it
 	if _, err := os.Stat(dir); err == nil {
 		opts.Logger.Debug("Using '%s' (database already exists)\n", dir)
+
+		// replay any WAL entries a prior run acknowledged but never
+		// flushed to disk (e.g. a crash between the two)
+		if driver.wal {
+			if err := driver.replayWAL(); err != nil {
+				return nil, err
+			}
+		}
+
 		return &driver, nil
 	}
 
@@ -90,18 +148,113 @@ func (d *Driver) Write(collection, resource string, v interface{}) error {
 		return fmt.Errorf("Missing collection - no place to save record!")
 	}
 
-	// ensure there is a resource (name) to save record as
-	if resource == "" {
-		return fmt.Errorf("Missing resource - unable to save record - no name!")
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return d.writeRecord(collection, resource, v)
+}
+
+// WriteAutoID locks the database and writes the record to the database under
+// [collection], assigning it the next auto-incrementing integer ID for that
+// collection (instead of a caller-supplied resource name) and returning the
+// assigned ID. This is handy when callers don't want to generate an ID
+// (e.g. a UUID) client-side before they have something to save.
+func (d *Driver) WriteAutoID(collection string, v interface{}) (int, error) {
+
+	// ensure there is a place to save record
+	if collection == "" {
+		return 0, fmt.Errorf("Missing collection - no place to save record!")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	id, err := d.nextID(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.writeRecord(collection, strconv.Itoa(id), v); err != nil {
+		return 0, err
+	}
+
+	if err := d.saveID(collection, id); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// WritePath locks the database and writes v to the record at [path], a
+// slash-joined collection/resource (or collection/sub/resource for nested
+// collections). It's equivalent to splitting [path] on its final slash and
+// calling Write(collection, resource, v), but lets callers build up nested
+// collections without joining the path themselves.
+func (d *Driver) WritePath(path string, v interface{}) error {
+
+	collection, resource := splitPath(path)
+
+	// ensure there is a place to save record
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to save record!")
 	}
 
 	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	return d.writeRecord(collection, resource, v)
+}
+
+// splitPath cleans [path] and splits it on its final slash into a collection
+// and a resource, e.g. "a/b/c" becomes ("a/b", "c")
+func splitPath(path string) (collection, resource string) {
+	path = filepath.ToSlash(filepath.Clean(path))
+
+	idx := strings.LastIndex(path, "/")
+	if idx < 0 {
+		return "", path
+	}
+
+	return path[:idx], path[idx+1:]
+}
+
+// writeRecord marshals v with the driver's codec and writes it to
+// [collection]/[resource]; callers must already hold the collection's mutex.
+// If Options.WAL is set, the marshaled record is appended to the
+// collection's WAL instead, and applied to the real file asynchronously.
+func (d *Driver) writeRecord(collection, resource string, v interface{}) error {
+
+	// ensure there is a resource (name) to save record as
+	if resource == "" {
+		return fmt.Errorf("Missing resource - unable to save record - no name!")
+	}
+
+	b, err := d.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if d.wal {
+		return d.appendWAL(collection, walOpWrite, resource, b)
+	}
+
+	return d.applyRecord(collection, resource, b)
+}
+
+// applyRecord durably writes b (an already-marshaled record) to
+// [collection]/[resource]: it's written to a temp file, fsynced, renamed
+// into place, and the containing directory is fsynced too, so the write
+// survives a crash right after Write returns rather than risking a
+// zero-length or missing file. Callers must already hold the collection's
+// mutex.
+func (d *Driver) applyRecord(collection, resource string, b []byte) error {
+
 	//
 	dir := filepath.Join(d.dir, collection)
-	fnlPath := filepath.Join(dir, resource)
+	fnlPath := filepath.Join(dir, resource+d.codec.Extension())
 	tmpPath := fnlPath + ".tmp"
 
 	// create collection directory
@@ -109,19 +262,100 @@ func (d *Driver) Write(collection, resource string, v interface{}) error {
 		return err
 	}
 
-	//
-	b, err := json.MarshalIndent(v, "", "\t")
+	// write marshaled data to the temp file, fsyncing it before it's closed
+	if err := writeFileSync(tmpPath, b); err != nil {
+		return err
+	}
+
+	// move final file into place, then fsync the directory so the rename
+	// itself is durable
+	if err := os.Rename(tmpPath, fnlPath); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	// keep any indexes built over this collection up to date
+	return d.updateIndexesOnWrite(collection, resource, b)
+}
+
+// writeFileSync writes b to path, fsyncing the file before closing it so the
+// data is durable on disk rather than just sitting in a kernel buffer
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 
-	// write marshaled data to the temp file
-	if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
+	if _, err := f.Write(b); err != nil {
+		f.Close()
 		return err
 	}
 
-	// move final file into place
-	return os.Rename(tmpPath, fnlPath)
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir fsyncs a directory, so a rename into (or removal from) it is
+// durable and not just the affected file itself
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// nextID returns the next auto-increment ID for [collection], read from the
+// collection's .meta file. If no .meta file exists yet, the counter is
+// seeded by scanning the collection for the highest numeric resource name
+// already in use. Callers must already hold the collection's mutex.
+func (d *Driver) nextID(collection string) (int, error) {
+	dir := filepath.Join(d.dir, collection)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, metaFile))
+	if err == nil {
+		last, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return 0, err
+		}
+		return last + 1, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// no .meta file yet - seed the counter from the highest numeric resource
+	// name already written to this collection
+	last := 0
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), d.codec.Extension())
+		if n, err := strconv.Atoi(name); err == nil && n > last {
+			last = n
+		}
+	}
+
+	return last + 1, nil
+}
+
+// saveID persists the most recently assigned auto-increment ID for
+// [collection] to its .meta file. Callers must already hold the collection's mutex.
+func (d *Driver) saveID(collection string, id int) error {
+	dir := filepath.Join(d.dir, collection)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, metaFile), []byte(strconv.Itoa(id)), 0644)
 }
 
 // Read a record from the database
@@ -137,8 +371,12 @@ func (d *Driver) Read(collection, resource string, v interface{}) error {
 		return fmt.Errorf("Missing resource - unable to read record - no name!")
 	}
 
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
 	//
-	record := filepath.Join(d.dir, collection, resource)
+	record := filepath.Join(d.dir, collection, resource+d.codec.Extension())
 
 	// check to see if file exists
 	if _, err := stat(record); err != nil {
@@ -152,7 +390,96 @@ func (d *Driver) Read(collection, resource string, v interface{}) error {
 	}
 
 	// unmarshal data
-	return json.Unmarshal(b, &v)
+	return d.codec.Unmarshal(b, &v)
+}
+
+// ReadPath reads the record or directory at [path], a slash-joined
+// collection/resource (or collection/sub/resource for nested collections),
+// into v. If [path] names a single record, it's read the same way Read
+// would read it. If [path] names a directory, every record under it is
+// read recursively and collected into v, which must be a pointer to a slice
+// (each decoded record is appended) or a pointer to a map keyed by the
+// record's path relative to [path] (without the codec's extension).
+func (d *Driver) ReadPath(path string, v interface{}) error {
+
+	// ensure there is a place to read record
+	if path == "" {
+		return fmt.Errorf("Missing path - no place to read record!")
+	}
+
+	collection, resource := splitPath(path)
+
+	// if [path] names a single record, read it like Read would
+	if _, err := stat(filepath.Join(d.dir, collection, resource+d.codec.Extension())); err == nil {
+		return d.Read(collection, resource, v)
+	}
+
+	// otherwise treat [path] as a directory to walk recursively. Lock the
+	// same way ReadAll does, so a concurrent Delete can't remove a file out
+	// from under filepath.Walk mid-read; this only covers [path] itself,
+	// not nested sub-collections the walk descends into, which serialize on
+	// their own mutexes (same caveat as Query - see query.go).
+	topCollection := filepath.ToSlash(filepath.Clean(path))
+	mutex := d.getOrCreateMutex(topCollection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	dir := filepath.Join(d.dir, topCollection)
+
+	fi, err := stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is neither a record nor a directory", dir)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return fmt.Errorf("ReadPath: v must be a pointer to a slice or a map")
+	}
+
+	switch rv.Elem().Kind() {
+	case reflect.Slice:
+		return d.readPathSlice(dir, rv.Elem())
+	case reflect.Map:
+		return d.readPathMap(dir, rv.Elem())
+	default:
+		return fmt.Errorf("ReadPath: v must be a pointer to a slice or a map")
+	}
+}
+
+// readPathSlice decodes every record under dir and appends it to slice.
+// Callers must already hold dir's top-level collection mutex.
+func (d *Driver) readPathSlice(dir string, slice reflect.Value) error {
+	return d.readRecords(dir, func(_ string, b []byte) error {
+		elem := reflect.New(slice.Type().Elem())
+		if err := d.codec.Unmarshal(b, elem.Interface()); err != nil {
+			return err
+		}
+
+		slice.Set(reflect.Append(slice, elem.Elem()))
+		return nil
+	})
+}
+
+// readPathMap decodes every record under dir into m, keyed by the record's
+// path relative to dir. Callers must already hold dir's top-level
+// collection mutex.
+func (d *Driver) readPathMap(dir string, m reflect.Value) error {
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+
+	return d.readRecords(dir, func(resource string, b []byte) error {
+		elem := reflect.New(m.Type().Elem())
+		if err := d.codec.Unmarshal(b, elem.Interface()); err != nil {
+			return err
+		}
+
+		m.SetMapIndex(reflect.ValueOf(resource), elem.Elem())
+		return nil
+	})
 }
 
 // ReadAll records from a collection; this is returned as a slice of strings because
@@ -164,6 +491,10 @@ func (d *Driver) ReadAll(collection string) ([]string, error) {
 		return nil, fmt.Errorf("Missing collection - unable to read location!")
 	}
 
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
 	//
 	dir := filepath.Join(d.dir, collection)
 
@@ -172,27 +503,16 @@ func (d *Driver) ReadAll(collection string) ([]string, error) {
 		return nil, fmt.Errorf("Directory '%s' does not exist - %s!", dir, err.Error())
 	}
 
-	// read all the files in the transaction.Collection; an error here just means
-	// the collection is either empty or doesn't exist
-	files, _ := ioutil.ReadDir(dir)
-
 	// the files read from the database
 	var records []string
 
-	// iterate over each of the files, attempting to read the file. If successful
-	// append the files to the collection of read files
-	for i := range files {
-		b, err := ioutil.ReadFile(filepath.Join(dir, files[i].Name()))
-		if err != nil {
-			return nil, err
-		}
-
-		// append read file
+	// walk the collection, appending the raw contents of every record found
+	err := d.readRecords(dir, func(_ string, b []byte) error {
 		records = append(records, string(b))
-	}
+		return nil
+	})
 
-	// unmarhsal the read files as a comma delimeted byte array
-	return records, nil
+	return records, err
 }
 
 // ReadAllMap records from a collection; this is returned as a string map of strings
@@ -205,6 +525,10 @@ func (d *Driver) ReadAllMap(collection string) (map[string]string, error) {
 		return nil, fmt.Errorf("Missing collection - unable to read location!")
 	}
 
+	mutex := d.getOrCreateMutex(collection)
+	mutex.RLock()
+	defer mutex.RUnlock()
+
 	//
 	dir := filepath.Join(d.dir, collection)
 
@@ -213,28 +537,48 @@ func (d *Driver) ReadAllMap(collection string) (map[string]string, error) {
 		return nil, fmt.Errorf("Directory '%s' does not exist - %s!", dir, err.Error())
 	}
 
-	// read all the files in the transaction.Collection; an error here just means
-	// the collection is either empty or doesn't exist
-	files, _ := ioutil.ReadDir(dir)
-
 	// the files read from the database (map[string] because the resource is a string)
-	var records = make(map[string]string)
+	records := make(map[string]string)
+
+	// walk the collection, keying the raw contents of every record found by
+	// its resource name (relative to the collection, without the codec's extension)
+	err := d.readRecords(dir, func(resource string, b []byte) error {
+		records[resource] = string(b)
+		return nil
+	})
 
-	// iterate over each of the files, attempting to read the file. If successful
-	// append the files to the collection of read files
-	for i := range files {
-		b, err := ioutil.ReadFile(filepath.Join(dir, files[i].Name()))
+	return records, err
+}
+
+// readRecords walks [dir] recursively, invoking fn with the resource name
+// (the record's path relative to dir, without the codec's extension) and raw
+// bytes of every record written with the driver's codec. Anything else found
+// along the way - directories, .meta files, .tmp leftovers from an
+// interrupted write, records from another codec - is skipped.
+func (d *Driver) readRecords(dir string, fn func(resource string, data []byte) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		// append read file
-		// records = append(records, string(b))
-		records[files[i].Name()] = string(b)
-	}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), d.codec.Extension()) {
+			return nil
+		}
 
-	// unmarhsal the read files as a comma delimeted byte array
-	return records, nil
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		resource := strings.TrimSuffix(filepath.ToSlash(rel), d.codec.Extension())
+
+		return fn(resource, b)
+	})
 }
 
 // Delete locks that database and then attempts to remove the collection/resource
@@ -249,27 +593,138 @@ func (d *Driver) Delete(collection, resource string) error {
 		return fmt.Errorf("Missing collection - no place to delete record!")
 	}
 
-	path := filepath.Join(collection, resource)
 	//
-	mutex := d.getOrCreateMutex(path)
+	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	// a blank resource means "delete the whole collection"; a non-blank one
+	// may itself be a sub-collection directory (e.g. one built up with
+	// WritePath) rather than a single record. Either way that's a directory,
+	// so check for one with no extension appended before assuming [resource]
+	// names a record - only a confirmed record gets the codec's extension.
+	noExtDir := filepath.Join(d.dir, collection, resource)
+
+	switch fi, err := stat(noExtDir); {
+
+	case fi == nil, err != nil:
+		if !strings.Contains(err.Error(), "no such file") {
+			return fmt.Errorf("Unable to stat %s - %s!", noExtDir, err.Error())
+		}
+
+	// remove the directory and all its contents, including any WAL it had
+	case fi.IsDir():
+		return os.RemoveAll(noExtDir)
+	}
+
+	// the whole collection was asked for and there was nothing there
+	if resource == "" || resource == "." {
+		return nil
+	}
+
+	// a single resource goes through the WAL like writes do, so the delete
+	// survives a crash before the next flush. This can't be gated on whether
+	// the record file already exists: an unflushed Write for the same
+	// resource may still be sitting only in the WAL, so stat-ing first would
+	// see nothing, treat the delete as a no-op, and let that pending write
+	// resurrect the record once the flusher runs.
+	if d.wal {
+		return d.appendWAL(collection, walOpDelete, resource, nil)
+	}
+
 	//
-	dir := filepath.Join(d.dir, path)
+	recordPath := filepath.Join(d.dir, collection, resource+d.codec.Extension())
 
-	switch fi, err := stat(dir); {
+	switch fi, err := stat(recordPath); {
 
 	// if fi is nil or error is not nil return
 	case fi == nil, err != nil:
 		if strings.Contains(err.Error(), "no such file") {
 			return nil
 		}
-		return fmt.Errorf("Unable to stat %s - %s!", dir, err.Error())
+		return fmt.Errorf("Unable to stat %s - %s!", recordPath, err.Error())
 
 	// remove file or directory and all contents
 	case fi.Mode().IsDir(), fi.Mode().IsRegular():
-		return os.RemoveAll(dir)
+		return d.applyDelete(collection, resource)
+	}
+
+	return nil
+}
+
+// applyDelete durably removes [collection]/[resource]'s record file and
+// keeps any indexes built over the collection in sync. Callers must already
+// hold the collection's mutex.
+func (d *Driver) applyDelete(collection, resource string) error {
+	dir := filepath.Join(d.dir, collection)
+	path := filepath.Join(dir, resource+d.codec.Extension())
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	return d.updateIndexesOnDelete(collection, resource)
+}
+
+// Convert rewrites every record in a collection from one codec's format to
+// another, e.g. moving a collection from JSONCodec to a more compact binary
+// codec once it's grown large. Records are read with [from] and written
+// back out with [to]; the old file is removed if the extension changed.
+func (d *Driver) Convert(collection string, from, to Codec) error {
+
+	// ensure there is a collection to convert
+	if collection == "" {
+		return fmt.Errorf("Missing collection - no place to convert!")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	//
+	dir := filepath.Join(d.dir, collection)
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, from.Extension()) {
+			continue
+		}
+
+		oldPath := filepath.Join(dir, name)
+		b, err := ioutil.ReadFile(oldPath)
+		if err != nil {
+			return err
+		}
+
+		var v interface{}
+		if err := from.Unmarshal(b, &v); err != nil {
+			return err
+		}
+
+		nb, err := to.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		resource := strings.TrimSuffix(name, from.Extension())
+		newPath := filepath.Join(dir, resource+to.Extension())
+		if err := ioutil.WriteFile(newPath, nb, 0644); err != nil {
+			return err
+		}
+
+		if newPath != oldPath {
+			if err := os.Remove(oldPath); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -282,7 +737,7 @@ func stat(path string) (os.FileInfo, error) {
 
 // getOrCreateMutex creates a new collection specific mutex any time a collection
 // is being modfied to avoid unsafe operations
-func (d *Driver) getOrCreateMutex(collection string) sync.Mutex {
+func (d *Driver) getOrCreateMutex(collection string) *sync.RWMutex {
 
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -291,7 +746,7 @@ func (d *Driver) getOrCreateMutex(collection string) sync.Mutex {
 
 	// if the mutex doesn't exist make it
 	if !ok {
-		m = sync.Mutex{}
+		m = &sync.RWMutex{}
 		d.mutexes[collection] = m
 	}
 
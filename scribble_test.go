@@ -2,20 +2,22 @@ package scribble_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jcelliott/lumber"
 	"github.com/nanobox-io/golang-scribble"
 )
 
-//
 type Fish struct {
 	Type string `json:"type"`
 }
 
-//
 var (
 	db         *scribble.Driver
 	database   = "/tmp/deep/school"
@@ -24,7 +26,6 @@ var (
 	bluefish   = Fish{Type: "blue"}
 )
 
-//
 func TestMain(m *testing.M) {
 
 	// remove any thing for a potentially failed previous test
@@ -49,7 +50,7 @@ func TestNew(t *testing.T) {
 	}
 	logger := lumber.NewConsoleLogger(lumber.WARN)
 	// test options
-	if _, err := scribble.New(database, &scribble.Options{logger}); err != nil {
+	if _, err := scribble.New(database, &scribble.Options{Logger: logger}); err != nil {
 		t.Error(err)
 		t.FailNow()
 	}
@@ -88,7 +89,6 @@ func TestNew(t *testing.T) {
 	}
 }
 
-//
 func TestWriteAndRead(t *testing.T) {
 
 	createDB(database)
@@ -114,7 +114,192 @@ func TestWriteAndRead(t *testing.T) {
 	}
 }
 
-//
+// Stresses a single collection with many concurrent writers and readers to
+// prove getOrCreateMutex's per-collection lock is actually shared (not
+// copied), so readers never observe a partial write or a torn rename.
+func TestConcurrentReadWrite(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	const writers = 20
+	const writesPer = 25
+
+	var wg sync.WaitGroup
+	wg.Add(writers * 2)
+
+	for w := 0; w < writers; w++ {
+		w := w
+		resource := strconv.Itoa(w)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writesPer; i++ {
+				fish := Fish{Type: fmt.Sprintf("%d-%d", w, i)}
+				if err := db.Write(collection, resource, fish); err != nil {
+					t.Error("Concurrent write failed: ", err.Error())
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writesPer; i++ {
+				var fish Fish
+				// a "does not exist" error just means this read raced the very
+				// first write for this resource; anything else is a real bug
+				if err := db.Read(collection, resource, &fish); err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					t.Error("Concurrent read failed: ", err.Error())
+					return
+				}
+				if fish.Type == "" {
+					t.Error("Read a partially written record")
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// every writer's final write should be intact and readable
+	for w := 0; w < writers; w++ {
+		var fish Fish
+		if err := db.Read(collection, strconv.Itoa(w), &fish); err != nil {
+			t.Error("Failed to read after concurrent writes: ", err.Error())
+			t.FailNow()
+		}
+		if want := fmt.Sprintf("%d-%d", w, writesPer-1); fish.Type != want {
+			t.Errorf("Expected final write %s, got: %s", want, fish.Type)
+		}
+	}
+}
+
+// TestConcurrentReadAllDelete guards against Delete locking a different
+// mutex than ReadAll: if it did, a Delete racing a ReadAll's filepath.Walk
+// could remove a record mid-walk and turn a safe operation into a spurious
+// "file not found" error.
+func TestConcurrentReadAllDelete(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	const resources = 20
+
+	for i := 0; i < resources; i++ {
+		if err := db.Write(collection, strconv.Itoa(i), redfish); err != nil {
+			t.Error("Create fish failed: ", err.Error())
+			t.FailNow()
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(resources + 1)
+
+	for i := 0; i < resources; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			if err := db.Delete(collection, strconv.Itoa(i)); err != nil {
+				t.Error("Concurrent delete failed: ", err.Error())
+			}
+		}()
+	}
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < resources; i++ {
+			if _, err := db.ReadAll(collection); err != nil {
+				t.Error("Concurrent ReadAll failed: ", err.Error())
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+// TestConcurrentReadPathDelete guards against ReadPath's directory-walk
+// branch reading with no lock held at all: if it did, a Delete racing the
+// walk could remove a record mid-walk and turn a safe read of an otherwise
+// untouched subtree into a spurious "file not found" error.
+func TestConcurrentReadPathDelete(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	const resources = 20
+
+	for i := 0; i < resources; i++ {
+		if err := db.Write(collection, strconv.Itoa(i), redfish); err != nil {
+			t.Error("Create fish failed: ", err.Error())
+			t.FailNow()
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(resources + 1)
+
+	for i := 0; i < resources; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			if err := db.Delete(collection, strconv.Itoa(i)); err != nil {
+				t.Error("Concurrent delete failed: ", err.Error())
+			}
+		}()
+	}
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < resources; i++ {
+			var fishies []Fish
+			if err := db.ReadPath(collection, &fishies); err != nil {
+				t.Error("Concurrent ReadPath failed: ", err.Error())
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestWriteAutoID(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	id, err := db.WriteAutoID(collection, redfish)
+	if err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+	if id != 1 {
+		t.Errorf("Expected first auto ID to be 1, got %d", id)
+		t.FailNow()
+	}
+
+	id, err = db.WriteAutoID(collection, bluefish)
+	if err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+	if id != 2 {
+		t.Errorf("Expected second auto ID to be 2, got %d", id)
+		t.FailNow()
+	}
+
+	var onefish Fish
+	if err := db.Read(collection, strconv.Itoa(id), &onefish); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+	if onefish.Type != bluefish.Type {
+		t.Error("Expected blue fish, got: ", onefish.Type)
+		t.FailNow()
+	}
+}
+
 func TestReadall(t *testing.T) {
 	createDB(database)
 	createSchool()
@@ -181,7 +366,59 @@ func TestReadallMap(t *testing.T) {
 	}
 }
 
-//
+func TestWritePathAndReadPath(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	// write a nested record
+	if err := db.WritePath(collection+"/tank1/redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	// read the single record back
+	var onefish Fish
+	if err := db.ReadPath(collection+"/tank1/redfish", &onefish); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+	if onefish.Type != redfish.Type {
+		t.Error("Expected red fish, got: ", onefish.Type)
+		t.FailNow()
+	}
+
+	// add a sibling tank and read the whole subtree into a slice
+	if err := db.WritePath(collection+"/tank2/bluefish", bluefish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	var fishies []Fish
+	if err := db.ReadPath(collection, &fishies); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+	if len(fishies) != 2 {
+		t.Errorf("Expected two fishies, have %d", len(fishies))
+		t.FailNow()
+	}
+
+	// and into a map, keyed by path relative to the collection
+	fishMap := map[string]Fish{}
+	if err := db.ReadPath(collection, &fishMap); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+	if fishMap["tank1/redfish"].Type != redfish.Type {
+		t.Error("Expected red fish, got: ", fishMap["tank1/redfish"].Type)
+		t.FailNow()
+	}
+	if fishMap["tank2/bluefish"].Type != bluefish.Type {
+		t.Error("Expected blue fish, got: ", fishMap["tank2/bluefish"].Type)
+		t.FailNow()
+	}
+}
+
 func TestWriteAndReadEmpty(t *testing.T) {
 	createDB(database)
 	defer destroySchool()
@@ -236,7 +473,6 @@ func TestWriteAndReadEmpty(t *testing.T) {
 	}
 }
 
-//
 func TestDelete(t *testing.T) {
 	createDB(database)
 	defer destroySchool()
@@ -274,7 +510,45 @@ func TestDelete(t *testing.T) {
 
 }
 
-//
+// TestDeleteSubCollection guards against Delete appending the codec's
+// extension to a resource that's actually a sub-collection directory (e.g.
+// one built up with WritePath) - that would stat a "resource.json" that
+// doesn't exist and silently no-op instead of removing the subtree.
+func TestDeleteSubCollection(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	if err := db.WritePath(collection+"/tank1/redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+	if err := db.WritePath(collection+"/tank2/bluefish", bluefish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	if err := db.Delete(collection, "tank1"); err != nil {
+		t.Error("Failed to delete sub-collection: ", err.Error())
+		t.FailNow()
+	}
+
+	if _, err := os.Stat(filepath.Join(database, collection, "tank1")); err == nil {
+		t.Error("Expected tank1 to be removed")
+		t.FailNow()
+	}
+
+	// the sibling sub-collection should be untouched
+	var onefish Fish
+	if err := db.Read(collection+"/tank2", "bluefish", &onefish); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+	if onefish.Type != bluefish.Type {
+		t.Error("Expected blue fish, got: ", onefish.Type)
+		t.FailNow()
+	}
+}
+
 func TestDeleteall(t *testing.T) {
 	createDB(database)
 	createSchool()
@@ -291,6 +565,358 @@ func TestDeleteall(t *testing.T) {
 	}
 }
 
+// fakeCodec is a stand-in binary codec used to verify the pluggable codec layer
+type fakeCodec struct{}
+
+func (fakeCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (fakeCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (fakeCodec) Extension() string                          { return ".fake" }
+
+// Tests that a Driver configured with a non-default Codec reads and writes
+// records under that codec's extension
+func TestCodec(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	fdb, err := scribble.New(database, &scribble.Options{Codec: fakeCodec{}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if err := fdb.Write(collection, "redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	if _, err := os.Stat(filepath.Join(database, collection, "redfish.fake")); err != nil {
+		t.Error("Expected record written with codec extension, got nothing")
+		t.FailNow()
+	}
+
+	var onefish Fish
+	if err := fdb.Read(collection, "redfish", &onefish); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+
+	if onefish.Type != redfish.Type {
+		t.Error("Expected red fish, got: ", onefish.Type)
+		t.FailNow()
+	}
+}
+
+// Tests that Convert rewrites records from one codec's format to another
+func TestConvert(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	if err := db.Write(collection, "redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	if err := db.Convert(collection, scribble.JSONCodec{}, fakeCodec{}); err != nil {
+		t.Error("Failed to convert: ", err.Error())
+		t.FailNow()
+	}
+
+	if _, err := os.Stat(filepath.Join(database, collection, "redfish.json")); err == nil {
+		t.Error("Expected old record to be gone after convert")
+		t.FailNow()
+	}
+
+	fdb, err := scribble.New(database, &scribble.Options{Codec: fakeCodec{}})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var onefish Fish
+	if err := fdb.Read(collection, "redfish", &onefish); err != nil {
+		t.Error("Failed to read converted record: ", err.Error())
+		t.FailNow()
+	}
+
+	if onefish.Type != redfish.Type {
+		t.Error("Expected red fish, got: ", onefish.Type)
+		t.FailNow()
+	}
+}
+
+// Tests that Options.WAL acknowledges writes/deletes immediately (durably
+// logged) and that they show up in the real record files once Checkpoint
+// forces the background flusher's work to happen synchronously
+func TestWAL(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	// a long flush interval keeps the background flusher from racing the
+	// "not yet flushed" assertion below
+	wdb, err := scribble.New(database, &scribble.Options{WAL: true, WALFlushInterval: time.Hour})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if err := wdb.Write(collection, "redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	if _, err := os.Stat(filepath.Join(database, collection, "redfish.json")); err == nil {
+		t.Error("Expected record to still be in the WAL, not yet flushed")
+		t.FailNow()
+	}
+
+	if err := wdb.Checkpoint(collection); err != nil {
+		t.Error("Failed to checkpoint: ", err.Error())
+		t.FailNow()
+	}
+
+	var onefish Fish
+	if err := wdb.Read(collection, "redfish", &onefish); err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+	if onefish.Type != redfish.Type {
+		t.Error("Expected red fish, got: ", onefish.Type)
+		t.FailNow()
+	}
+
+	if err := wdb.Delete(collection, "redfish"); err != nil {
+		t.Error("Failed to delete: ", err.Error())
+		t.FailNow()
+	}
+
+	if err := wdb.Checkpoint(collection); err != nil {
+		t.Error("Failed to checkpoint: ", err.Error())
+		t.FailNow()
+	}
+
+	if err := wdb.Read(collection, "redfish", &onefish); err == nil {
+		t.Error("Expected nothing, got fish")
+		t.FailNow()
+	}
+}
+
+// TestWALDeleteBeforeFlush guards against Delete dropping a delete for a
+// record whose Write is still sitting unflushed in the WAL: stat-ing the
+// record file first would see nothing and treat the delete as a no-op,
+// letting the pending write resurrect the record on the next flush.
+func TestWALDeleteBeforeFlush(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	// a long flush interval keeps the background flusher from racing the
+	// "not yet flushed" assertion below
+	wdb, err := scribble.New(database, &scribble.Options{WAL: true, WALFlushInterval: time.Hour})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	if err := wdb.Write(collection, "redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	if _, err := os.Stat(filepath.Join(database, collection, "redfish.json")); err == nil {
+		t.Error("Expected record to still be in the WAL, not yet flushed")
+		t.FailNow()
+	}
+
+	// delete before the write has ever been flushed to disk
+	if err := wdb.Delete(collection, "redfish"); err != nil {
+		t.Error("Failed to delete: ", err.Error())
+		t.FailNow()
+	}
+
+	if err := wdb.Checkpoint(collection); err != nil {
+		t.Error("Failed to checkpoint: ", err.Error())
+		t.FailNow()
+	}
+
+	var onefish Fish
+	if err := wdb.Read(collection, "redfish", &onefish); err == nil {
+		t.Error("Expected nothing, got resurrected fish")
+		t.FailNow()
+	}
+}
+
+func TestQuery(t *testing.T) {
+	createDB(database)
+	createSchool()
+	defer destroySchool()
+
+	resources, err := db.Query(collection, func(raw json.RawMessage) bool {
+		var fish Fish
+		if err := json.Unmarshal(raw, &fish); err != nil {
+			t.Error("Failed to unmarshal fish - ", err.Error())
+			return false
+		}
+		return fish.Type == redfish.Type
+	})
+	if err != nil {
+		t.Error("Failed to query: ", err.Error())
+		t.FailNow()
+	}
+
+	if len(resources) != 1 {
+		t.Errorf("Expected one matching resource, have %d", len(resources))
+		t.FailNow()
+	}
+}
+
+func TestQueryInto(t *testing.T) {
+	createDB(database)
+	createSchool()
+	defer destroySchool()
+
+	var fishies []Fish
+	if err := db.QueryInto(collection, &fishies, func(v interface{}) bool {
+		fish, ok := v.(Fish)
+		return ok && fish.Type == bluefish.Type
+	}); err != nil {
+		t.Error("Failed to query: ", err.Error())
+		t.FailNow()
+	}
+
+	if len(fishies) != 1 || fishies[0].Type != bluefish.Type {
+		t.Errorf("Expected one blue fish, got %v", fishies)
+		t.FailNow()
+	}
+}
+
+func TestCreateIndexAndLookup(t *testing.T) {
+	createDB(database)
+	createSchool()
+	defer destroySchool()
+
+	if err := db.CreateIndex(collection, "type"); err != nil {
+		t.Error("Failed to create index: ", err.Error())
+		t.FailNow()
+	}
+
+	resources, err := db.Lookup(collection, "type", redfish.Type)
+	if err != nil {
+		t.Error("Failed to look up: ", err.Error())
+		t.FailNow()
+	}
+	if len(resources) != 1 || resources[0] != "0" {
+		t.Errorf("Expected [0], got %v", resources)
+		t.FailNow()
+	}
+
+	// writing a new matching record should be picked up incrementally
+	if err := db.Write(collection, "2", Fish{Type: redfish.Type}); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	resources, err = db.Lookup(collection, "type", redfish.Type)
+	if err != nil {
+		t.Error("Failed to look up: ", err.Error())
+		t.FailNow()
+	}
+	if len(resources) != 2 {
+		t.Errorf("Expected two matching resources, got %v", resources)
+		t.FailNow()
+	}
+
+	// deleting one should drop it from the index too
+	if err := db.Delete(collection, "0"); err != nil {
+		t.Error("Failed to delete: ", err.Error())
+		t.FailNow()
+	}
+
+	resources, err = db.Lookup(collection, "type", redfish.Type)
+	if err != nil {
+		t.Error("Failed to look up: ", err.Error())
+		t.FailNow()
+	}
+	if len(resources) != 1 || resources[0] != "2" {
+		t.Errorf("Expected [2], got %v", resources)
+		t.FailNow()
+	}
+}
+
+// TestConcurrentIndexWriteDelete guards against updateIndexesOnWrite and
+// updateIndexesOnDelete serializing under two different locks: if they did,
+// concurrent Write/Delete on indexed resources could read-modify-write the
+// same index sidecar at once and lose an update.
+func TestConcurrentIndexWriteDelete(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	const resources = 20
+
+	// seed the collection first: CreateIndex needs its directory to exist
+	for i := 0; i < resources; i++ {
+		if err := db.Write(collection, strconv.Itoa(i), redfish); err != nil {
+			t.Error("Create fish failed: ", err.Error())
+			t.FailNow()
+		}
+	}
+
+	if err := db.CreateIndex(collection, "type"); err != nil {
+		t.Error("Failed to create index: ", err.Error())
+		t.FailNow()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(resources * 2)
+
+	for i := 0; i < resources; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			if err := db.Write(collection, strconv.Itoa(i), bluefish); err != nil {
+				t.Error("Concurrent write failed: ", err.Error())
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			if err := db.Delete(collection, strconv.Itoa(i)); err != nil {
+				t.Error("Concurrent delete failed: ", err.Error())
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// whichever of Write/Delete landed last for each resource, the index
+	// must still parse and agree with what's actually on disk
+	resources2, err := db.Lookup(collection, "type", bluefish.Type)
+	if err != nil {
+		t.Error("Failed to look up: ", err.Error())
+		t.FailNow()
+	}
+
+	records, err := db.ReadAllMap(collection)
+	if err != nil {
+		t.Error("Failed to read: ", err.Error())
+		t.FailNow()
+	}
+
+	want := 0
+	for _, raw := range records {
+		var fish Fish
+		if err := json.Unmarshal([]byte(raw), &fish); err != nil {
+			t.Error("Failed to unmarshal fish - ", err.Error())
+			t.FailNow()
+		}
+		if fish.Type == bluefish.Type {
+			want++
+		}
+	}
+
+	if len(resources2) != want {
+		t.Errorf("Index out of sync with disk: index has %d, disk has %d", len(resources2), want)
+	}
+}
+
 // Functions used in testing
 
 // create a new scribble database
@@ -0,0 +1,261 @@
+package scribble
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walFile is the append-only log Options.WAL keeps inside a collection
+// directory; every write and single-record delete made while WAL is enabled lands here
+// (fsynced) before the driver acknowledges it
+const walFile = ".wal"
+
+// walFlushInterval is the default for Options.WALFlushInterval: how often
+// the background flusher checkpoints a collection once writes have started
+// arriving for it
+const walFlushInterval = 10 * time.Millisecond
+
+// walOp identifies what a WAL frame represents
+type walOp byte
+
+const (
+	walOpWrite walOp = iota
+	walOpDelete
+)
+
+// walFrame is a single logged operation against one resource
+type walFrame struct {
+	op       walOp
+	resource string
+	payload  []byte // the marshaled record; unset for a delete
+}
+
+// walCollection is the per-collection bookkeeping Options.WAL needs: a
+// dedicated mutex serializing access to that collection's WAL file (append
+// vs. checkpoint's read-and-truncate), and whether its background flusher
+// has already been started.
+type walCollection struct {
+	mu      sync.Mutex
+	started bool
+}
+
+// walFor returns (creating if necessary) the WAL bookkeeping for collection
+func (d *Driver) walFor(collection string) *walCollection {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	wc, ok := d.wals[collection]
+	if !ok {
+		wc = &walCollection{}
+		d.wals[collection] = wc
+	}
+
+	return wc
+}
+
+// appendWAL appends a single {op, resource, payload} frame to collection's
+// WAL, fsyncing it before returning, and makes sure that collection's
+// background flusher is running. The real record file isn't touched here -
+// the flusher (or a manual Checkpoint) applies it.
+func (d *Driver) appendWAL(collection string, op walOp, resource string, payload []byte) error {
+	wc := d.walFor(collection)
+
+	wc.mu.Lock()
+	err := func() error {
+		dir := filepath.Join(d.dir, collection)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := f.Write(encodeWALFrame(op, resource, payload)); err != nil {
+			return err
+		}
+
+		return f.Sync()
+	}()
+	wc.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	d.startFlusher(collection, wc)
+	return nil
+}
+
+// startFlusher starts collection's background flusher the first time it's
+// asked for; later calls are no-ops
+func (d *Driver) startFlusher(collection string, wc *walCollection) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if wc.started {
+		return
+	}
+	wc.started = true
+
+	go d.flushLoop(collection, wc)
+}
+
+// flushLoop periodically checkpoints collection for as long as the process
+// runs - Driver has no Close to stop it early, matching the rest of the
+// package's lifecycle-free design
+func (d *Driver) flushLoop(collection string, wc *walCollection) {
+	ticker := time.NewTicker(d.walFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		wc.mu.Lock()
+		d.checkpointLocked(collection)
+		wc.mu.Unlock()
+		mutex.Unlock()
+	}
+}
+
+// Checkpoint replays every frame currently in collection's WAL into its real
+// per-resource files, then truncates the log. It's a no-op if nothing is
+// pending, and safe to call whether or not Options.WAL is enabled.
+func (d *Driver) Checkpoint(collection string) error {
+
+	// ensure there is a collection to checkpoint
+	if collection == "" {
+		return fmt.Errorf("Missing collection - nothing to checkpoint!")
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	wc := d.walFor(collection)
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	return d.checkpointLocked(collection)
+}
+
+// checkpointLocked does the actual work of Checkpoint. Callers must already
+// hold both the collection's main mutex (so applying records can't race a
+// concurrent Read/ReadAll/Query) and its WAL mutex (so the read-and-truncate
+// below can't race a concurrent appendWAL).
+func (d *Driver) checkpointLocked(collection string) error {
+	dir := filepath.Join(d.dir, collection)
+	path := filepath.Join(dir, walFile)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+
+	for _, frame := range decodeWALFrames(b) {
+		var err error
+		switch frame.op {
+		case walOpWrite:
+			err = d.applyRecord(collection, frame.resource, frame.payload)
+		case walOpDelete:
+			err = d.applyDelete(collection, frame.resource)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// replayWAL checkpoints every collection under the database root that has a
+// pending WAL, so writes acknowledged just before a crash aren't lost
+func (d *Driver) replayWAL() error {
+	return filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != walFile {
+			return nil
+		}
+
+		collection, err := filepath.Rel(d.dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		return d.Checkpoint(filepath.ToSlash(collection))
+	})
+}
+
+// encodeWALFrame serializes a WAL frame as
+// [4-byte frame length][1-byte op][4-byte resource length][resource][payload]
+func encodeWALFrame(op walOp, resource string, payload []byte) []byte {
+	body := make([]byte, 0, 1+4+len(resource)+len(payload))
+
+	var resLen [4]byte
+	binary.BigEndian.PutUint32(resLen[:], uint32(len(resource)))
+
+	body = append(body, byte(op))
+	body = append(body, resLen[:]...)
+	body = append(body, resource...)
+	body = append(body, payload...)
+
+	var frameLen [4]byte
+	binary.BigEndian.PutUint32(frameLen[:], uint32(len(body)))
+
+	return append(frameLen[:], body...)
+}
+
+// decodeWALFrames reads every complete frame out of b. A truncated trailing
+// frame (e.g. a crash mid-append) is silently dropped.
+func decodeWALFrames(b []byte) []walFrame {
+	var frames []walFrame
+
+	for len(b) >= 4 {
+		frameLen := binary.BigEndian.Uint32(b[:4])
+		b = b[4:]
+		if uint64(frameLen) > uint64(len(b)) {
+			break
+		}
+
+		frame := b[:frameLen]
+		b = b[frameLen:]
+
+		if len(frame) < 5 {
+			continue
+		}
+
+		op := walOp(frame[0])
+		resLen := binary.BigEndian.Uint32(frame[1:5])
+		frame = frame[5:]
+		if uint64(resLen) > uint64(len(frame)) {
+			continue
+		}
+
+		frames = append(frames, walFrame{
+			op:       op,
+			resource: string(frame[:resLen]),
+			payload:  frame[resLen:],
+		})
+	}
+
+	return frames
+}
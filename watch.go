@@ -0,0 +1,208 @@
+package scribble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type (
+	// Op describes what kind of change an Event represents
+	Op int
+
+	// Event describes a single change to a record within a watched collection
+	Event struct {
+		Op         Op
+		Collection string
+		Resource   string
+		Data       []byte // the record's contents; unset for Delete events
+	}
+)
+
+const (
+	// Write is emitted whenever a record is created or updated
+	Write Op = iota
+	// Delete is emitted whenever a record is removed
+	Delete
+)
+
+// Watch watches [collection] for changes and returns a channel of Events
+// along with a function to stop watching and release the underlying
+// resources. It's built on fsnotify, so the temp-file-then-rename dance
+// Write does internally is coalesced into a single Write event, and deletes
+// (whether by Delete or by removing the file directly) show up as a single
+// Delete event.
+func (d *Driver) Watch(collection string) (<-chan Event, func(), error) {
+
+	// ensure there is a place to watch
+	if collection == "" {
+		return nil, nil, fmt.Errorf("Missing collection - nothing to watch!")
+	}
+
+	dir := filepath.Join(d.dir, collection)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+
+	events := make(chan Event)
+	done := make(chan struct{})
+
+	go d.watchLoop(watcher, collection, dir, events, done)
+
+	stop := func() {
+		close(done)
+		watcher.Close()
+	}
+
+	return events, stop, nil
+}
+
+// RecursiveWatch behaves like Watch, but also watches every collection
+// nested under [prefix], so writes to deeply nested collections (as made
+// possible by WritePath) produce events too.
+func (d *Driver) RecursiveWatch(prefix string) (<-chan Event, func(), error) {
+
+	// ensure there is a place to watch
+	if prefix == "" {
+		return nil, nil, fmt.Errorf("Missing collection - nothing to watch!")
+	}
+
+	root := filepath.Join(d.dir, prefix)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := addRecursive(watcher, root); err != nil {
+		watcher.Close()
+		return nil, nil, err
+	}
+
+	events := make(chan Event)
+	done := make(chan struct{})
+
+	go d.recursiveWatchLoop(watcher, prefix, root, events, done)
+
+	stop := func() {
+		close(done)
+		watcher.Close()
+	}
+
+	return events, stop, nil
+}
+
+// addRecursive adds dir and every subdirectory beneath it to watcher
+func addRecursive(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// watchLoop forwards fsnotify events for a single collection as Events,
+// until done is closed
+func (d *Driver) watchLoop(watcher *fsnotify.Watcher, collection, dir string, events chan Event, done chan struct{}) {
+	defer close(events)
+
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			d.handleWatchEvent(event, collection, dir, events)
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// watcher errors are dropped; the loop keeps forwarding events
+		}
+	}
+}
+
+// recursiveWatchLoop behaves like watchLoop, but also watches newly created
+// subdirectories so nested collections created after the call to
+// RecursiveWatch are picked up too
+func (d *Driver) recursiveWatchLoop(watcher *fsnotify.Watcher, prefix, root string, events chan Event, done chan struct{}) {
+	defer close(events)
+
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					watcher.Add(event.Name)
+					continue
+				}
+			}
+
+			d.handleWatchEvent(event, prefix, root, events)
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// handleWatchEvent turns a raw fsnotify.Event on a file under dir into an
+// Event, skipping anything that isn't a finished record of this driver's
+// codec (the .tmp intermediate from Write, records from another codec, etc.)
+func (d *Driver) handleWatchEvent(event fsnotify.Event, collection, dir string, events chan Event) {
+	rel, err := filepath.Rel(dir, event.Name)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+
+	if strings.HasSuffix(rel, ".tmp") || !strings.HasSuffix(rel, d.codec.Extension()) {
+		return
+	}
+
+	resource := strings.TrimSuffix(rel, d.codec.Extension())
+
+	switch {
+	case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		b, err := ioutil.ReadFile(event.Name)
+		if err != nil {
+			// the file vanished between the event firing and the read; it'll
+			// show up as its own Remove/Rename event
+			return
+		}
+		events <- Event{Op: Write, Collection: collection, Resource: resource, Data: b}
+
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		events <- Event{Op: Delete, Collection: collection, Resource: resource}
+	}
+}
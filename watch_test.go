@@ -0,0 +1,85 @@
+package scribble_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nanobox-io/golang-scribble"
+)
+
+func TestWatch(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	events, stop, err := db.Watch(collection)
+	if err != nil {
+		t.Error("Failed to watch: ", err.Error())
+		t.FailNow()
+	}
+	defer stop()
+
+	if err := db.Write(collection, "redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	select {
+	case event := <-events:
+		if event.Op != scribble.Write || event.Collection != collection || event.Resource != "redfish" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for write event")
+		t.FailNow()
+	}
+
+	if err := db.Delete(collection, "redfish"); err != nil {
+		t.Error("Failed to delete: ", err.Error())
+		t.FailNow()
+	}
+
+	select {
+	case event := <-events:
+		if event.Op != scribble.Delete || event.Resource != "redfish" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for delete event")
+		t.FailNow()
+	}
+}
+
+func TestRecursiveWatch(t *testing.T) {
+	createDB(database)
+	defer destroySchool()
+
+	// tank1 needs to already exist before we start watching, since a
+	// brand new sub-collection is only picked up once its own Create event
+	// has been processed, racing whatever first write created it
+	if err := db.WritePath(collection+"/tank1/seed", bluefish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	events, stop, err := db.RecursiveWatch(collection)
+	if err != nil {
+		t.Error("Failed to watch: ", err.Error())
+		t.FailNow()
+	}
+	defer stop()
+
+	if err := db.WritePath(collection+"/tank1/redfish", redfish); err != nil {
+		t.Error("Create fish failed: ", err.Error())
+		t.FailNow()
+	}
+
+	select {
+	case event := <-events:
+		if event.Op != scribble.Write || event.Resource != "tank1/redfish" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for write event")
+		t.FailNow()
+	}
+}